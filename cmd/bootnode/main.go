@@ -0,0 +1,107 @@
+// bootnode runs a bootstrap node for the Ethereum Discovery Protocol.
+package main
+
+import (
+	"crypto/ecdsa"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/nat"
+)
+
+func main() {
+	var (
+		listenAddr  = flag.String("addr", ":30301", "listen address")
+		genKey      = flag.String("genkey", "", "generate a node key and write it to given filename")
+		nodeKeyFile = flag.String("nodekey", "", "private key filename")
+		nodeKeyHex  = flag.String("nodekeyhex", "", "private key as hex (for testing)")
+		natdesc     = flag.String("nat", "none", "port mapping mechanism (any, extip:<IP>, upnp, pmp, none)")
+	)
+	flag.Parse()
+
+	natIface, err := nat.Parse(*natdesc)
+	if err != nil {
+		fmt.Printf("-nat: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *genKey != "" {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			fmt.Printf("could not generate key: %v\n", err)
+			os.Exit(1)
+		}
+		if err := crypto.SaveECDSA(*genKey, key); err != nil {
+			fmt.Printf("could not save key: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var nodeKey *ecdsa.PrivateKey
+	switch {
+	case *nodeKeyFile != "" && *nodeKeyHex != "":
+		fmt.Println("Options -nodekey and -nodekeyhex are mutually exclusive")
+		os.Exit(1)
+	case *nodeKeyFile != "":
+		if nodeKey, err = crypto.LoadECDSA(*nodeKeyFile); err != nil {
+			fmt.Printf("-nodekey: %v\n", err)
+			os.Exit(1)
+		}
+	case *nodeKeyHex != "":
+		if nodeKey, err = crypto.HexToECDSA(*nodeKeyHex); err != nil {
+			fmt.Printf("-nodekeyhex: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("Use -nodekey or -nodekeyhex to specify a private key, or -genkey to create one")
+		os.Exit(1)
+	}
+
+	tab, err := discover.ListenUDP(nodeKey, *listenAddr, natIface)
+	if err != nil {
+		fmt.Printf("could not start discovery: %v\n", err)
+		os.Exit(1)
+	}
+
+	ip := externalIP(natIface, *listenAddr)
+	fmt.Printf("enode://%x@%v\n", discover.PubkeyID(&nodeKey.PublicKey).Bytes(), ip)
+
+	_ = tab
+	select {} // run forever
+}
+
+// externalIP returns the address that should be published in the node's
+// enode URL: the NAT-discovered external IP when available, otherwise the
+// address of the local interface that would route outbound traffic (the
+// common case with the default "-nat none", where listenAddr alone has no
+// usable host).
+func externalIP(natIface nat.Interface, listenAddr string) string {
+	_, port, _ := net.SplitHostPort(listenAddr)
+	if natIface != nil {
+		if ip, err := natIface.ExternalIP(); err == nil {
+			return net.JoinHostPort(ip.String(), port)
+		}
+	}
+	if host := outboundIP(); host != "" {
+		return net.JoinHostPort(host, port)
+	}
+	return listenAddr
+}
+
+// outboundIP returns the local address that would be used to route traffic
+// to the public internet. Dialing UDP doesn't send any packets, it just
+// asks the kernel to pick a route, which is all that's needed here.
+func outboundIP() string {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	return host
+}
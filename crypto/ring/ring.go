@@ -0,0 +1,168 @@
+// Package ring implements AOS/LSAG-style linkable ring signatures over
+// secp256k1. A ring signature proves a message was signed by one member of
+// a set of public keys without revealing which one; "linkable" means the
+// same signer reusing the same ring yields the same key image, so a
+// verifier can detect (without identifying) a double-signature.
+package ring
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"math/big"
+
+	"github.com/ShyftNetwork/go-empyrean/crypto"
+)
+
+var curve = crypto.S256()
+
+// Signature is a linkable ring signature: the key image I identifies the
+// signer's (secret) position without exposing it, C0 is the first ring
+// challenge, and S holds one response scalar per ring member.
+type Signature struct {
+	KeyImage *ecdsa.PublicKey
+	C0       *big.Int
+	S        []*big.Int
+}
+
+// Sign produces a linkable ring signature of msg under ring[signerIdx],
+// using priv, the private key matching that ring member. ring must list
+// every member's public key, including the signer's, in the fixed order
+// the verifier will use.
+func Sign(msg []byte, ring []*ecdsa.PublicKey, signerIdx int, priv *ecdsa.PrivateKey) (*Signature, error) {
+	n := len(ring)
+	if signerIdx < 0 || signerIdx >= n {
+		return nil, errors.New("ring: signer index out of range")
+	}
+
+	hp := make([]*ecdsa.PublicKey, n)
+	for i, p := range ring {
+		h, err := hashToPoint(p)
+		if err != nil {
+			return nil, err
+		}
+		hp[i] = h
+	}
+	keyImage := scalarMultPoint(hp[signerIdx], priv.D)
+
+	c := make([]*big.Int, n)
+	s := make([]*big.Int, n)
+
+	u, err := randScalar()
+	if err != nil {
+		return nil, err
+	}
+	pi := signerIdx
+	uGx, uGy := curve.ScalarBaseMult(u.Bytes())
+	uHx, uHy := curve.ScalarMult(hp[pi].X, hp[pi].Y, u.Bytes())
+	c[(pi+1)%n] = challenge(msg, uGx, uGy, uHx, uHy)
+
+	for step := 1; step < n; step++ {
+		i := (pi + step) % n
+		si, err := randScalar()
+		if err != nil {
+			return nil, err
+		}
+		s[i] = si
+
+		sgx, sgy := curve.ScalarBaseMult(si.Bytes())
+		cpx, cpy := curve.ScalarMult(ring[i].X, ring[i].Y, c[i].Bytes())
+		zx, zy := curve.Add(sgx, sgy, cpx, cpy)
+
+		shx, shy := curve.ScalarMult(hp[i].X, hp[i].Y, si.Bytes())
+		cix, ciy := curve.ScalarMult(keyImage.X, keyImage.Y, c[i].Bytes())
+		wx, wy := curve.Add(shx, shy, cix, ciy)
+
+		c[(i+1)%n] = challenge(msg, zx, zy, wx, wy)
+	}
+
+	order := curve.Params().N
+	cx := new(big.Int).Mul(c[pi], priv.D)
+	s[pi] = new(big.Int).Mod(new(big.Int).Sub(u, cx), order)
+
+	return &Signature{KeyImage: keyImage, C0: c[0], S: s}, nil
+}
+
+// Verify reports whether sig is a valid ring signature of msg under ring.
+func Verify(msg []byte, sig *Signature, ring []*ecdsa.PublicKey) bool {
+	n := len(ring)
+	if sig == nil || sig.KeyImage == nil || sig.C0 == nil || len(sig.S) != n {
+		return false
+	}
+	hp := make([]*ecdsa.PublicKey, n)
+	for i, p := range ring {
+		h, err := hashToPoint(p)
+		if err != nil {
+			return false
+		}
+		hp[i] = h
+	}
+
+	c := sig.C0
+	for i := 0; i < n; i++ {
+		if sig.S[i] == nil {
+			return false
+		}
+		sgx, sgy := curve.ScalarBaseMult(sig.S[i].Bytes())
+		cpx, cpy := curve.ScalarMult(ring[i].X, ring[i].Y, c.Bytes())
+		zx, zy := curve.Add(sgx, sgy, cpx, cpy)
+
+		shx, shy := curve.ScalarMult(hp[i].X, hp[i].Y, sig.S[i].Bytes())
+		cix, ciy := curve.ScalarMult(sig.KeyImage.X, sig.KeyImage.Y, c.Bytes())
+		wx, wy := curve.Add(shx, shy, cix, ciy)
+
+		c = challenge(msg, zx, zy, wx, wy)
+	}
+	return c.Cmp(sig.C0) == 0
+}
+
+// hashToPoint maps pub to another point on the curve via try-and-increment:
+// keccak256(serialize(pub) || counter) is taken as a candidate x-coordinate
+// until one yields a valid point, per secp256k1's y² = x³ + 7 (mod p), which
+// has a solution for roughly half of all x values.
+func hashToPoint(pub *ecdsa.PublicKey) (*ecdsa.PublicKey, error) {
+	p := curve.Params().P
+	base := elliptic.Marshal(curve, pub.X, pub.Y)
+
+	sqrtExp := new(big.Int).Add(p, big.NewInt(1))
+	sqrtExp.Rsh(sqrtExp, 2) // valid because secp256k1's p ≡ 3 (mod 4)
+
+	for counter := 0; counter < 256; counter++ {
+		h := crypto.Keccak256(base, []byte{byte(counter)})
+		x := new(big.Int).Mod(new(big.Int).SetBytes(h), p)
+
+		rhs := new(big.Int).Exp(x, big.NewInt(3), p)
+		rhs.Add(rhs, big.NewInt(7))
+		rhs.Mod(rhs, p)
+
+		y := new(big.Int).Exp(rhs, sqrtExp, p)
+		check := new(big.Int).Mul(y, y)
+		check.Mod(check, p)
+		if check.Cmp(rhs) == 0 {
+			return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+		}
+	}
+	return nil, errors.New("ring: hash-to-curve did not converge")
+}
+
+func scalarMultPoint(p *ecdsa.PublicKey, d *big.Int) *ecdsa.PublicKey {
+	x, y := curve.ScalarMult(p.X, p.Y, d.Bytes())
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+}
+
+// challenge hashes msg together with an arbitrary number of curve points
+// (passed as consecutive X, Y big.Int pairs) down to a scalar mod the
+// group order.
+func challenge(msg []byte, coords ...*big.Int) *big.Int {
+	data := [][]byte{msg}
+	for _, c := range coords {
+		data = append(data, c.Bytes())
+	}
+	h := crypto.Keccak256(data...)
+	return new(big.Int).Mod(new(big.Int).SetBytes(h), curve.Params().N)
+}
+
+func randScalar() (*big.Int, error) {
+	return rand.Int(rand.Reader, curve.Params().N)
+}
@@ -0,0 +1,71 @@
+package ring
+
+import (
+	"crypto/ecdsa"
+	"testing"
+
+	"github.com/ShyftNetwork/go-empyrean/crypto"
+)
+
+func testRing(t *testing.T, n int) ([]*ecdsa.PrivateKey, []*ecdsa.PublicKey) {
+	privs := make([]*ecdsa.PrivateKey, n)
+	pubs := make([]*ecdsa.PublicKey, n)
+	for i := 0; i < n; i++ {
+		priv, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		privs[i] = priv
+		pubs[i] = &priv.PublicKey
+	}
+	return privs, pubs
+}
+
+func TestSignVerify(t *testing.T) {
+	privs, pubs := testRing(t, 5)
+	msg := []byte("transfer 1 SHYFT")
+
+	for signer := range pubs {
+		sig, err := Sign(msg, pubs, signer, privs[signer])
+		if err != nil {
+			t.Fatalf("signer %d: %v", signer, err)
+		}
+		if !Verify(msg, sig, pubs) {
+			t.Fatalf("signature by ring member %d did not verify", signer)
+		}
+	}
+}
+
+func TestVerifyRejectsTamperedMessage(t *testing.T) {
+	privs, pubs := testRing(t, 3)
+	sig, err := Sign([]byte("original"), pubs, 0, privs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Verify([]byte("tampered"), sig, pubs) {
+		t.Fatal("signature verified against a different message")
+	}
+}
+
+func TestKeyImageIsLinkable(t *testing.T) {
+	privs, pubs := testRing(t, 4)
+	sig1, err := Sign([]byte("first message"), pubs, 2, privs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig2, err := Sign([]byte("second message"), pubs, 2, privs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig1.KeyImage.X.Cmp(sig2.KeyImage.X) != 0 || sig1.KeyImage.Y.Cmp(sig2.KeyImage.Y) != 0 {
+		t.Fatal("same signer over the same ring produced different key images")
+	}
+
+	sig3, err := Sign([]byte("third message"), pubs, 1, privs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig1.KeyImage.X.Cmp(sig3.KeyImage.X) == 0 {
+		t.Fatal("different signers produced the same key image")
+	}
+}
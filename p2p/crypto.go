@@ -0,0 +1,332 @@
+package p2p
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// cryptoId runs the RLPx authenticated handshake on behalf of a Peer and,
+// once it completes, yields a MsgReadWriter that transparently
+// encrypts/authenticates every frame.
+type cryptoId struct {
+	privKey *ecdsa.PrivateKey
+}
+
+func newCryptoId(priv *ecdsa.PrivateKey) (*cryptoId, error) {
+	if priv == nil {
+		return nil, fmt.Errorf("cryptoId requires a private key")
+	}
+	return &cryptoId{privKey: priv}, nil
+}
+
+// secrets are the symmetric keys derived at the end of the handshake.
+type secrets struct {
+	AES        []byte
+	MacSecret  []byte
+	EgressMAC  hash.Hash
+	IngressMAC hash.Hash
+}
+
+// authMsgLen is len(signature) + len(keccak256(ephemeral-pubkey)) +
+// len(initiator-pubkey) + len(nonce) + len(version byte).
+const (
+	sigLen      = 65
+	pubLen      = 64
+	nonceLen    = 32
+	authMsgLen  = sigLen + 32 + pubLen + nonceLen + 1
+	authRespLen = pubLen + nonceLen + 1
+)
+
+// NewSession performs the RLPx handshake over rw, either as initiator
+// (dialer) or responder (listener), and returns a MsgReadWriter that
+// frames, encrypts and authenticates all further traffic. The handshake
+// always negotiates a fresh ephemeral key; there is no session resumption.
+func (c *cryptoId) NewSession(r *bufio.Reader, w io.Writer, remotePub []byte, initiator bool) (MsgReadWriter, error) {
+	var s secrets
+	var err error
+	if initiator {
+		// The dialer already knows who it's talking to (from discovery),
+		// so its claimed identity is checked up front.
+		remote, perr := rawToPubkey(remotePub)
+		if perr != nil {
+			return nil, fmt.Errorf("invalid remote public key: %v", perr)
+		}
+		s, _, _, err = c.runInitiator(r, w, remote)
+	} else {
+		// A freshly accepted connection has no known remote public key yet
+		// (Peer.PublicKey is empty until the handshake completes); the
+		// responder instead recovers the initiator's static key from the
+		// auth packet's signature, so it needs no remotePub up front.
+		s, _, _, err = c.runResponder(r, w)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newRlpxFrameRW(r, w, s), nil
+}
+
+func (c *cryptoId) runInitiator(r *bufio.Reader, w io.Writer, remote *ecdsa.PublicKey) (s secrets, authPkt, respPkt []byte, err error) {
+	ephemeral, err := crypto.GenerateKey()
+	if err != nil {
+		return s, nil, nil, err
+	}
+	nonce := make([]byte, nonceLen)
+	if _, err = rand.Read(nonce); err != nil {
+		return s, nil, nil, err
+	}
+
+	staticShared := ecdh(c.privKey, remote)
+	token := xor(staticShared, nonce)
+	sig, err := crypto.Sign(token, ephemeral)
+	if err != nil {
+		return s, nil, nil, err
+	}
+
+	msg := make([]byte, authMsgLen)
+	copy(msg[:sigLen], sig)
+	copy(msg[sigLen:sigLen+32], crypto.Keccak256(pubkeyToRaw(&ephemeral.PublicKey)))
+	copy(msg[sigLen+32:sigLen+32+pubLen], pubkeyToRaw(&c.privKey.PublicKey))
+	copy(msg[sigLen+32+pubLen:sigLen+32+pubLen+nonceLen], nonce)
+	// trailing version byte left zero
+
+	authPkt, err = eciesEncrypt(remote, msg)
+	if err != nil {
+		return s, nil, nil, err
+	}
+	if err = writeFrame(w, authPkt); err != nil {
+		return s, nil, nil, err
+	}
+
+	respPkt, err = readFrame(r)
+	if err != nil {
+		return s, nil, nil, err
+	}
+	respMsg, err := eciesDecrypt(c.privKey, respPkt)
+	if err != nil {
+		return s, nil, nil, err
+	}
+	if len(respMsg) < authRespLen {
+		return s, nil, nil, fmt.Errorf("auth-resp too short")
+	}
+	remoteEphemeral, err := rawToPubkey(respMsg[:pubLen])
+	if err != nil {
+		return s, nil, nil, err
+	}
+	remoteNonce := respMsg[pubLen : pubLen+nonceLen]
+
+	s = deriveSecrets(ecdh(ephemeral, remoteEphemeral), nonce, remoteNonce, authPkt, respPkt, true)
+	return s, authPkt, respPkt, nil
+}
+
+func (c *cryptoId) runResponder(r *bufio.Reader, w io.Writer) (s secrets, authPkt, respPkt []byte, err error) {
+	authPkt, err = readFrame(r)
+	if err != nil {
+		return s, nil, nil, err
+	}
+	authMsg, err := eciesDecrypt(c.privKey, authPkt)
+	if err != nil {
+		return s, nil, nil, err
+	}
+	if len(authMsg) < authMsgLen {
+		return s, nil, nil, fmt.Errorf("auth message too short")
+	}
+	sig := authMsg[:sigLen]
+	initiatorPub, err := rawToPubkey(authMsg[sigLen+32 : sigLen+32+pubLen])
+	if err != nil {
+		return s, nil, nil, err
+	}
+	remoteNonce := authMsg[sigLen+32+pubLen : sigLen+32+pubLen+nonceLen]
+
+	staticShared := ecdh(c.privKey, initiatorPub)
+	token := xor(staticShared, remoteNonce)
+	remoteEphemeral, err := crypto.SigToPub(token, sig)
+	if err != nil {
+		return s, nil, nil, fmt.Errorf("invalid auth signature: %v", err)
+	}
+
+	ephemeral, err := crypto.GenerateKey()
+	if err != nil {
+		return s, nil, nil, err
+	}
+	nonce := make([]byte, nonceLen)
+	if _, err = rand.Read(nonce); err != nil {
+		return s, nil, nil, err
+	}
+
+	resp := make([]byte, authRespLen)
+	copy(resp[:pubLen], pubkeyToRaw(&ephemeral.PublicKey))
+	copy(resp[pubLen:pubLen+nonceLen], nonce)
+
+	respPkt, err = eciesEncrypt(initiatorPub, resp)
+	if err != nil {
+		return s, nil, nil, err
+	}
+	if err = writeFrame(w, respPkt); err != nil {
+		return s, nil, nil, err
+	}
+
+	s = deriveSecrets(ecdh(ephemeral, remoteEphemeral), remoteNonce, nonce, authPkt, respPkt, false)
+	return s, authPkt, respPkt, nil
+}
+
+// deriveSecrets implements the key schedule from the handshake spec:
+//
+//	shared-secret = keccak256(ephemeral-secret, keccak256(nonce-resp, nonce-init))
+//	aes-secret    = keccak256(ephemeral-secret, shared-secret)
+//	mac-secret    = keccak256(ephemeral-secret, aes-secret)
+//
+// Each side seeds its egress MAC state with mac-secret XOR the remote
+// side's nonce, hashed together with the packet it sent itself, and its
+// ingress MAC state with mac-secret XOR its own nonce, hashed together with
+// the packet the remote side sent.
+func deriveSecrets(ephemeralShared, initNonce, respNonce, authPkt, respPkt []byte, initiator bool) secrets {
+	sharedSecret := crypto.Keccak256(ephemeralShared, crypto.Keccak256(respNonce, initNonce))
+	aesSecret := crypto.Keccak256(ephemeralShared, sharedSecret)
+	macSecret := crypto.Keccak256(ephemeralShared, aesSecret)
+
+	egressSeed := crypto.Keccak256(xor(macSecret, respNonce), authPkt)
+	ingressSeed := crypto.Keccak256(xor(macSecret, initNonce), respPkt)
+	if !initiator {
+		egressSeed, ingressSeed = crypto.Keccak256(xor(macSecret, initNonce), respPkt),
+			crypto.Keccak256(xor(macSecret, respNonce), authPkt)
+	}
+
+	egress := crypto.NewKeccak256()
+	egress.Write(egressSeed)
+	ingress := crypto.NewKeccak256()
+	ingress.Write(ingressSeed)
+
+	return secrets{AES: aesSecret, MacSecret: macSecret, EgressMAC: egress, IngressMAC: ingress}
+}
+
+func ecdh(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey) []byte {
+	x, _ := pub.Curve.ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	return x.Bytes()
+}
+
+func xor(a, b []byte) []byte {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	out := make([]byte, n)
+	for i := 0; i < n; i++ {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+func pubkeyToRaw(pub *ecdsa.PublicKey) []byte {
+	return elliptic.Marshal(pub.Curve, pub.X, pub.Y)[1:]
+}
+
+func rawToPubkey(raw []byte) (*ecdsa.PublicKey, error) {
+	if len(raw) != pubLen {
+		return nil, fmt.Errorf("expected %d byte pubkey, got %d", pubLen, len(raw))
+	}
+	pub := &ecdsa.PublicKey{Curve: crypto.S256(), X: new(big.Int), Y: new(big.Int)}
+	pub.X.SetBytes(raw[:32])
+	pub.Y.SetBytes(raw[32:])
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("invalid curve point")
+	}
+	return pub, nil
+}
+
+// eciesEncrypt encrypts msg to pub using ECIES: an ephemeral ECDH shared
+// secret feeds a SHA-256 KDF that produces an AES-256-CTR key and an
+// HMAC-SHA256 authentication key.
+func eciesEncrypt(pub *ecdsa.PublicKey, msg []byte) ([]byte, error) {
+	ephemeral, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	shared := ecdh(ephemeral, pub)
+	encKey, macKey := eciesKDF(shared)
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(msg))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, msg)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	tag := mac.Sum(nil)
+
+	ephemeralRaw := elliptic.Marshal(ephemeral.PublicKey.Curve, ephemeral.PublicKey.X, ephemeral.PublicKey.Y)
+	out := make([]byte, 0, len(ephemeralRaw)+len(iv)+len(ciphertext)+len(tag))
+	out = append(out, ephemeralRaw...)
+	out = append(out, iv...)
+	out = append(out, ciphertext...)
+	out = append(out, tag...)
+	return out, nil
+}
+
+func eciesDecrypt(priv *ecdsa.PrivateKey, data []byte) ([]byte, error) {
+	const ephemeralLen = 65 // uncompressed point, 0x04 prefix included
+	if len(data) < ephemeralLen+aes.BlockSize+sha256.Size {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	x, y := elliptic.Unmarshal(crypto.S256(), data[:ephemeralLen])
+	if x == nil {
+		return nil, fmt.Errorf("invalid ephemeral public key")
+	}
+	ephemeralPub := &ecdsa.PublicKey{Curve: crypto.S256(), X: x, Y: y}
+	shared := ecdh(priv, ephemeralPub)
+	encKey, macKey := eciesKDF(shared)
+
+	rest := data[ephemeralLen:]
+	iv := rest[:aes.BlockSize]
+	tag := rest[len(rest)-sha256.Size:]
+	ciphertext := rest[aes.BlockSize : len(rest)-sha256.Size]
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return nil, fmt.Errorf("invalid MAC")
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(msg, ciphertext)
+	return msg, nil
+}
+
+// eciesKDF is a NIST SP 800-56 style concatenation KDF built on SHA-256; it
+// derives a 32 byte AES key and a 32 byte MAC key from the ECDH secret.
+func eciesKDF(shared []byte) (encKey, macKey []byte) {
+	out := make([]byte, 0, 64)
+	for counter := uint32(1); len(out) < 64; counter++ {
+		var ctr [4]byte
+		binary.BigEndian.PutUint32(ctr[:], counter)
+		h := sha256.New()
+		h.Write(ctr[:])
+		h.Write(shared)
+		out = append(out, h.Sum(nil)...)
+	}
+	return out[:32], out[32:64]
+}
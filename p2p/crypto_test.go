@@ -0,0 +1,131 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestECIESRoundTrip(t *testing.T) {
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("the auth packet payload that gets ECIES-sealed to the remote static key")
+	ct, err := eciesEncrypt(&priv.PublicKey, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := eciesDecrypt(priv, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pt, msg) {
+		t.Fatalf("roundtrip mismatch: got %q, want %q", pt, msg)
+	}
+}
+
+func TestECDHSymmetric(t *testing.T) {
+	a, _ := crypto.GenerateKey()
+	b, _ := crypto.GenerateKey()
+	if !bytes.Equal(ecdh(a, &b.PublicKey), ecdh(b, &a.PublicKey)) {
+		t.Fatal("ECDH shared secret is not symmetric")
+	}
+}
+
+func TestPubkeyRawRoundTrip(t *testing.T) {
+	priv, _ := crypto.GenerateKey()
+	raw := pubkeyToRaw(&priv.PublicKey)
+	if len(raw) != pubLen {
+		t.Fatalf("raw pubkey length = %d, want %d", len(raw), pubLen)
+	}
+	pub, err := rawToPubkey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.X.Cmp(priv.PublicKey.X) != 0 || pub.Y.Cmp(priv.PublicKey.Y) != 0 {
+		t.Fatal("pubkey changed across raw roundtrip")
+	}
+}
+
+func TestDeriveSecretsSymmetry(t *testing.T) {
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rand.Read(b)
+		return b
+	}
+	ephemeralShared := random(32)
+	initNonce := random(nonceLen)
+	respNonce := random(nonceLen)
+	authPkt := random(authMsgLen)
+	respPkt := random(authRespLen)
+
+	init := deriveSecrets(ephemeralShared, initNonce, respNonce, authPkt, respPkt, true)
+	resp := deriveSecrets(ephemeralShared, initNonce, respNonce, authPkt, respPkt, false)
+
+	if !bytes.Equal(init.AES, resp.AES) {
+		t.Fatal("aes-secret differs between initiator and responder views")
+	}
+	if !bytes.Equal(init.EgressMAC.Sum(nil), resp.IngressMAC.Sum(nil)) {
+		t.Fatal("initiator egress MAC should seed the same state as responder ingress MAC")
+	}
+	if !bytes.Equal(init.IngressMAC.Sum(nil), resp.EgressMAC.Sum(nil)) {
+		t.Fatal("initiator ingress MAC should seed the same state as responder egress MAC")
+	}
+}
+
+// TestNewSessionHandshake drives cryptoId.NewSession as both initiator and
+// responder over a connected pair, the way Peer.handleCryptoHandshake does
+// for a real dial/accept. It guards against the responder side requiring a
+// remote public key it can't possibly have yet (a freshly accepted
+// connection has no claimed identity until the auth packet arrives).
+func TestNewSessionHandshake(t *testing.T) {
+	initiatorConn, responderConn := net.Pipe()
+	defer initiatorConn.Close()
+	defer responderConn.Close()
+
+	initiatorKey, _ := crypto.GenerateKey()
+	responderKey, _ := crypto.GenerateKey()
+	initiatorID := mustCryptoId(t, initiatorKey)
+	responderID := mustCryptoId(t, responderKey)
+
+	type result struct {
+		rw  MsgReadWriter
+		err error
+	}
+	initiatorDone := make(chan result, 1)
+	responderDone := make(chan result, 1)
+
+	go func() {
+		rw, err := initiatorID.NewSession(bufio.NewReader(initiatorConn), initiatorConn, pubkeyToRaw(&responderKey.PublicKey), true)
+		initiatorDone <- result{rw, err}
+	}()
+	go func() {
+		// The responder doesn't know who's dialing in yet, so it is given
+		// no remote public key at all.
+		rw, err := responderID.NewSession(bufio.NewReader(responderConn), responderConn, nil, false)
+		responderDone <- result{rw, err}
+	}()
+
+	initRes := <-initiatorDone
+	respRes := <-responderDone
+	if initRes.err != nil {
+		t.Fatalf("initiator handshake failed: %v", initRes.err)
+	}
+	if respRes.err != nil {
+		t.Fatalf("responder handshake failed: %v", respRes.err)
+	}
+}
+
+func mustCryptoId(t *testing.T, priv *ecdsa.PrivateKey) *cryptoId {
+	c, err := newCryptoId(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
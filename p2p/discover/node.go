@@ -0,0 +1,130 @@
+package discover
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// NodeID is a unique identifier for each node, derived from the node's
+// secp256k1 public key (the 0x04 prefix byte is stripped).
+type NodeID [64]byte
+
+// Bytes returns a byte slice representation of the NodeID.
+func (n NodeID) Bytes() []byte {
+	return n[:]
+}
+
+// String returns the hex string representation of the NodeID.
+func (n NodeID) String() string {
+	return fmt.Sprintf("%x", n[:])
+}
+
+// PubkeyID returns a marshaled representation of the given public key.
+func PubkeyID(pub *ecdsa.PublicKey) NodeID {
+	var id NodeID
+	pbytes := elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+	if len(pbytes)-1 != len(id) {
+		panic(fmt.Errorf("need %d bit pubkey, got %d bits", (len(id)+1)*8, len(pbytes)*8))
+	}
+	copy(id[:], pbytes[1:])
+	return id
+}
+
+// Pubkey returns the public key represented by the node ID.
+func (n NodeID) Pubkey() (*ecdsa.PublicKey, error) {
+	p := &ecdsa.PublicKey{Curve: crypto.S256(), X: new(big.Int), Y: new(big.Int)}
+	half := len(n) / 2
+	p.X.SetBytes(n[:half])
+	p.Y.SetBytes(n[half:])
+	if !p.Curve.IsOnCurve(p.X, p.Y) {
+		return nil, fmt.Errorf("id is invalid secp256k1 curve point")
+	}
+	return p, nil
+}
+
+// HexID converts a hex string to a NodeID.
+func HexID(in string) (NodeID, error) {
+	var id NodeID
+	b, err := hex.DecodeString(in)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != len(id) {
+		return id, fmt.Errorf("wrong length, want %d hex chars", len(id)*2)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// MustHexID converts a hex string to a NodeID and panics if it is invalid.
+func MustHexID(in string) NodeID {
+	id, err := HexID(in)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// Node represents a host on the network. Node fields should not be modified
+// directly, call methods instead.
+type Node struct {
+	IP      net.IP
+	UDPPort uint16
+	TCPPort uint16
+	ID      NodeID
+	sha     NodeID // keccak256 hash of ID, used as the XOR distance key
+}
+
+func newNode(id NodeID, ip net.IP, udpPort, tcpPort uint16) *Node {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	return &Node{
+		IP:      ip,
+		UDPPort: udpPort,
+		TCPPort: tcpPort,
+		ID:      id,
+		sha:     hashNodeID(id),
+	}
+}
+
+func (n *Node) addr() *net.UDPAddr {
+	return &net.UDPAddr{IP: n.IP, Port: int(n.UDPPort)}
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("enode://%x@%s:%d", n.ID[:], n.IP, n.TCPPort)
+}
+
+// hashNodeID returns the keccak256 hash of a node ID, used to compute
+// XOR distances in the routing table.
+func hashNodeID(id NodeID) (h NodeID) {
+	copy(h[:], crypto.Keccak256(id[:]))
+	return h
+}
+
+// logdist returns the logarithmic distance between a and b, i.e. the
+// total number of bits minus the number of leading bits on which a and b
+// agree (512 when the top bit differs). It returns 0 if a == b.
+func logdist(a, b NodeID) int {
+	lz := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			lz += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			lz++
+			x <<= 1
+		}
+		break
+	}
+	return len(a)*8 - lz
+}
@@ -0,0 +1,206 @@
+// Package discover implements the Node Discovery Protocol, a Kademlia-like
+// DHT that ethereum nodes use to find peering candidates without any
+// centralized infrastructure.
+package discover
+
+import (
+	"crypto/ecdsa"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/logger"
+)
+
+const (
+	alpha           = 3  // Kademlia concurrency factor
+	bucketSize      = 16 // Kademlia bucket size (k)
+	hashBits        = len(NodeID{}) * 8
+	nBuckets        = hashBits + 1 // one bucket per possible log-distance, plus distance 0
+	maxBondingPings = 16           // not used: this package has no bonding logic
+	refreshInterval = 1 * time.Hour
+)
+
+// Table is a Kademlia-like routing table of known nodes, bucketed by
+// log-distance from self. It satisfies the peer candidate needs of
+// Server: nodes can be added as they're discovered and pulled back out
+// at random or nearest-to-target for dialing.
+type Table struct {
+	mutex   sync.Mutex
+	buckets [nBuckets]*bucket
+	self    *Node
+	net     transport
+}
+
+// transport is implemented by the UDP discovery layer so Table can issue
+// FINDNODE/PING requests without depending on net.Conn directly.
+type transport interface {
+	findnode(target NodeID, node *Node) ([]*Node, error)
+	ping(node *Node) error
+	close()
+}
+
+type bucket struct {
+	entries []*Node
+}
+
+func newTable(t transport, self *Node) *Table {
+	tab := &Table{net: t, self: self}
+	for i := range tab.buckets {
+		tab.buckets[i] = new(bucket)
+	}
+	return tab
+}
+
+// Self returns the local node.
+func (tab *Table) Self() *Node {
+	return tab.self
+}
+
+// Add inserts a newly discovered node into the appropriate k-bucket. If the
+// bucket is full, the node is dropped; existing entries are not pinged or
+// evicted to make room for it.
+func (tab *Table) Add(n *Node) {
+	if n.ID == tab.self.ID {
+		return
+	}
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+	b := tab.bucket(n.sha)
+	for _, e := range b.entries {
+		if e.ID == n.ID {
+			return
+		}
+	}
+	if len(b.entries) < bucketSize {
+		b.entries = append(b.entries, n)
+	}
+}
+
+// Remove drops a node from the table, e.g. after it fails to answer a ping.
+func (tab *Table) Remove(n *Node) {
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+	b := tab.bucket(n.sha)
+	for i, e := range b.entries {
+		if e.ID == n.ID {
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+func (tab *Table) bucket(sha NodeID) *bucket {
+	d := logdist(tab.self.sha, sha)
+	return tab.buckets[d]
+}
+
+// Closest returns the n nodes closest to target, ordered by ascending
+// distance.
+func (tab *Table) Closest(target NodeID, n int) []*Node {
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+
+	var all []*Node
+	for _, b := range tab.buckets {
+		all = append(all, b.entries...)
+	}
+	th := hashNodeID(target)
+	sort.Slice(all, func(i, j int) bool {
+		return logdist(th, all[i].sha) < logdist(th, all[j].sha)
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// Bootstrap seeds the table with a known-good list of entry nodes and then
+// performs a self-lookup to fill in the rest of the table. It is normally
+// called once, right after the table is created.
+func (tab *Table) Bootstrap(nodes []*Node) {
+	for _, n := range nodes {
+		tab.Add(n)
+	}
+	tab.Lookup(tab.self.ID)
+}
+
+// Lookup performs a Kademlia node lookup for the given target. It queries
+// each not-yet-asked node among the closest known ones, one at a time (not
+// alpha requests in parallel), keeps the bucketSize closest of all nodes
+// returned, and repeats until a round asks no new node.
+func (tab *Table) Lookup(target NodeID) []*Node {
+	var (
+		asked  = make(map[NodeID]bool)
+		result = tab.Closest(target, bucketSize)
+	)
+	asked[tab.self.ID] = true
+	for {
+		progress := false
+		for _, n := range result {
+			if asked[n.ID] {
+				continue
+			}
+			asked[n.ID] = true
+			found, err := tab.net.findnode(target, n)
+			if err != nil {
+				continue
+			}
+			for _, f := range found {
+				tab.Add(f)
+			}
+			result = append(result, found...)
+			progress = true
+		}
+		if !progress {
+			break
+		}
+		th := hashNodeID(target)
+		sort.Slice(result, func(i, j int) bool {
+			return logdist(th, result[i].sha) < logdist(th, result[j].sha)
+		})
+		if len(result) > bucketSize {
+			result = result[:bucketSize]
+		}
+	}
+	return result
+}
+
+// Random returns a random node from the table, or nil if the table is empty.
+// Server's dial loop uses this to pick peering candidates when it has no
+// specific target in mind.
+func (tab *Table) Random() *Node {
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+
+	var nonEmpty []*bucket
+	for _, b := range tab.buckets {
+		if len(b.entries) > 0 {
+			nonEmpty = append(nonEmpty, b)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return nil
+	}
+	b := nonEmpty[rand.Intn(len(nonEmpty))]
+	return b.entries[rand.Intn(len(b.entries))]
+}
+
+var tabLogger = logger.NewLogger("DISCOVER")
+
+// loop periodically refreshes the table by performing a self lookup so
+// long-lived nodes keep their bucket entries populated even without new
+// inbound connections.
+func (tab *Table) loop() {
+	refresh := time.NewTicker(refreshInterval)
+	defer refresh.Stop()
+	for range refresh.C {
+		tab.Lookup(tab.self.ID)
+	}
+}
+
+// unused but kept for callers that construct a self node from a key.
+func selfFromKey(key *ecdsa.PrivateKey) NodeID {
+	return PubkeyID(&key.PublicKey)
+}
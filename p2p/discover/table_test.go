@@ -0,0 +1,55 @@
+package discover
+
+import (
+	"crypto/ecdsa"
+	"net"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func newTestNode(t *testing.T, ip string) (*Node, *ecdsa.PrivateKey) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newNode(PubkeyID(&key.PublicKey), net.ParseIP(ip), 30303, 30303), key
+}
+
+func TestTable_AddAndClosest(t *testing.T) {
+	self, _ := newTestNode(t, "127.0.0.1")
+	tab := newTable(nil, self)
+
+	n1, _ := newTestNode(t, "127.0.0.2")
+	n2, _ := newTestNode(t, "127.0.0.3")
+	tab.Add(n1)
+	tab.Add(n2)
+
+	closest := tab.Closest(n1.ID, 2)
+	if len(closest) != 2 {
+		t.Fatalf("expected 2 nodes, got %d", len(closest))
+	}
+	if closest[0].ID != n1.ID {
+		t.Errorf("expected %v to be closest to itself, got %v", n1.ID, closest[0].ID)
+	}
+}
+
+func TestTable_AddSelfIgnored(t *testing.T) {
+	self, _ := newTestNode(t, "127.0.0.1")
+	tab := newTable(nil, self)
+	tab.Add(self)
+	if len(tab.Closest(self.ID, 10)) != 0 {
+		t.Errorf("table should not contain the local node")
+	}
+}
+
+func TestLogdist(t *testing.T) {
+	var a, b NodeID
+	if logdist(a, b) != 0 {
+		t.Errorf("logdist of equal ids should be 0")
+	}
+	b[0] = 0x80
+	if d := logdist(a, b); d != 512 {
+		t.Errorf("logdist = %d, want 512", d)
+	}
+}
@@ -0,0 +1,347 @@
+package discover
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/p2p/nat"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// RPC packet types. Every packet is hash(32) || signature(65) || type(1) ||
+// RLP-encoded payload, where the type byte holds one of these values.
+const (
+	pingPacket = iota + 1
+	pongPacket
+	findnodePacket
+	neighborsPacket
+)
+
+const (
+	respTimeout = 500 * time.Millisecond
+	sigLen      = 65 // secp256k1 signature length
+	headSize    = 32 + sigLen
+)
+
+type (
+	ping struct {
+		IP         string
+		Port       uint16
+		Expiration uint64
+	}
+
+	pong struct {
+		ReplyTok   []byte
+		Expiration uint64
+	}
+
+	findnode struct {
+		Target     NodeID
+		Expiration uint64
+	}
+
+	neighbors struct {
+		Nodes      []rpcNode
+		Expiration uint64
+	}
+
+	rpcNode struct {
+		IP   net.IP
+		Port uint16
+		ID   NodeID
+	}
+)
+
+// udp implements the RLPx discovery wire protocol: it signs and verifies
+// every packet with the local node's private key and dispatches replies to
+// the Table's Kademlia logic.
+type udp struct {
+	conn        *net.UDPConn
+	priv        *ecdsa.PrivateKey
+	ourEndpoint rpcNode
+	tab         *Table
+
+	addpending chan *pending
+	gotreply   chan reply
+	closing    chan struct{}
+}
+
+// pending represents a pending reply. Some implementations of the protocol
+// wish to send more than one discovery packet at a time, so this struct
+// identifies a particular waiting request.
+type pending struct {
+	from     NodeID
+	ptype    byte
+	deadline time.Time
+	callback func(resp interface{}) (done bool)
+	errc     chan<- error
+}
+
+type reply struct {
+	from    NodeID
+	ptype   byte
+	data    interface{}
+	matched chan<- bool
+}
+
+// ListenUDP returns a new table that uses the given private key to identify
+// itself and listens for discovery packets on addr. natIface is used to
+// punch a hole for the UDP port if not nil.
+func ListenUDP(priv *ecdsa.PrivateKey, addr string, natIface nat.Interface) (*Table, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	if natIface != nil {
+		go nat.Map(natIface, nil, "udp", laddr.Port, laddr.Port, "ethereum discovery")
+	}
+
+	self := newNode(PubkeyID(&priv.PublicKey), laddr.IP, uint16(laddr.Port), uint16(laddr.Port))
+	udp := &udp{
+		conn:       conn,
+		priv:       priv,
+		closing:    make(chan struct{}),
+		addpending: make(chan *pending),
+		gotreply:   make(chan reply),
+	}
+	udp.tab = newTable(udp, self)
+
+	go udp.loop()
+	go udp.readLoop()
+	go udp.tab.loop()
+	return udp.tab, nil
+}
+
+func (t *udp) close() {
+	close(t.closing)
+	t.conn.Close()
+}
+
+func (t *udp) ping(node *Node) error {
+	errc := make(chan error, 1)
+	t.send(node, pingPacket, ping{
+		IP:         node.IP.String(),
+		Port:       node.UDPPort,
+		Expiration: futureExpiration(),
+	})
+	t.addpending <- &pending{
+		from:  node.ID,
+		ptype: pongPacket,
+		callback: func(interface{}) bool {
+			return true
+		},
+		errc: errc,
+	}
+	return <-errc
+}
+
+func (t *udp) findnode(target NodeID, node *Node) ([]*Node, error) {
+	nodes := make([]*Node, 0, bucketSize)
+	errc := make(chan error, 1)
+	t.send(node, findnodePacket, findnode{Target: target, Expiration: futureExpiration()})
+	t.addpending <- &pending{
+		from:  node.ID,
+		ptype: neighborsPacket,
+		callback: func(r interface{}) bool {
+			rep := r.(*neighbors)
+			for _, rn := range rep.Nodes {
+				nodes = append(nodes, newNode(rn.ID, rn.IP, rn.Port, rn.Port))
+			}
+			return true
+		},
+		errc: errc,
+	}
+	return nodes, <-errc
+}
+
+func (t *udp) loop() {
+	var pendingList []*pending
+	timeout := time.NewTimer(0)
+	defer timeout.Stop()
+
+	for {
+		resetTimeout := func() {
+			if len(pendingList) == 0 {
+				return
+			}
+			timeout.Reset(respTimeout)
+		}
+
+		select {
+		case <-t.closing:
+			for _, p := range pendingList {
+				p.errc <- fmt.Errorf("discovery shut down")
+			}
+			return
+
+		case p := <-t.addpending:
+			p.deadline = time.Now().Add(respTimeout)
+			pendingList = append(pendingList, p)
+			resetTimeout()
+
+		case r := <-t.gotreply:
+			var matched bool
+			for i := 0; i < len(pendingList); i++ {
+				p := pendingList[i]
+				if p.from == r.from && p.ptype == r.ptype {
+					matched = true
+					if p.callback(r.data) {
+						p.errc <- nil
+						pendingList = append(pendingList[:i], pendingList[i+1:]...)
+						i--
+					}
+				}
+			}
+			r.matched <- matched
+
+		case now := <-timeout.C:
+			for i := 0; i < len(pendingList); i++ {
+				if p := pendingList[i]; !now.Before(p.deadline) {
+					p.errc <- fmt.Errorf("RPC timeout")
+					pendingList = append(pendingList[:i], pendingList[i+1:]...)
+					i--
+				}
+			}
+			resetTimeout()
+		}
+	}
+}
+
+func (t *udp) readLoop() {
+	buf := make([]byte, 1280)
+	for {
+		n, from, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if err := t.handlePacket(from, buf[:n]); err != nil {
+			logger.NewLogger("DISCOVER").Warnf("bad packet from %v: %v", from, err)
+		}
+	}
+}
+
+func (t *udp) handlePacket(from *net.UDPAddr, buf []byte) error {
+	packet, fromID, err := decodePacket(buf)
+	if err != nil {
+		return err
+	}
+	switch p := packet.(type) {
+	case *ping:
+		t.send(&Node{IP: from.IP, UDPPort: uint16(from.Port)}, pongPacket, pong{
+			ReplyTok:   crypto.Keccak256(buf[headSize:]),
+			Expiration: futureExpiration(),
+		})
+		t.tab.Add(newNode(fromID, from.IP, uint16(from.Port), uint16(from.Port)))
+	case *pong:
+		t.reply(fromID, pongPacket, p)
+	case *findnode:
+		closest := t.tab.Closest(p.Target, bucketSize)
+		nodes := make([]rpcNode, 0, len(closest))
+		for _, n := range closest {
+			nodes = append(nodes, rpcNode{IP: n.IP, Port: n.TCPPort, ID: n.ID})
+		}
+		t.send(&Node{IP: from.IP, UDPPort: uint16(from.Port)}, neighborsPacket, neighbors{
+			Nodes:      nodes,
+			Expiration: futureExpiration(),
+		})
+	case *neighbors:
+		t.reply(fromID, neighborsPacket, p)
+	}
+	return nil
+}
+
+func (t *udp) reply(from NodeID, ptype byte, data interface{}) bool {
+	matched := make(chan bool, 1)
+	select {
+	case t.gotreply <- reply{from, ptype, data, matched}:
+		return <-matched
+	case <-t.closing:
+		return false
+	}
+}
+
+// send signs and writes a discovery packet of the given type to node.
+func (t *udp) send(node *Node, ptype byte, req interface{}) error {
+	payload, err := rlp.EncodeToBytes(req)
+	if err != nil {
+		return err
+	}
+	packet := make([]byte, headSize+1+len(payload))
+	packet[headSize] = ptype
+	copy(packet[headSize+1:], payload)
+
+	sig, err := crypto.Sign(crypto.Keccak256(packet[headSize:]), t.priv)
+	if err != nil {
+		return err
+	}
+	copy(packet[32:headSize], sig)
+	copy(packet[:32], crypto.Keccak256(packet[32:]))
+
+	_, err = t.conn.WriteToUDP(packet, &net.UDPAddr{IP: node.IP, Port: int(node.UDPPort)})
+	return err
+}
+
+// decodePacket verifies the packet hash and signature and recovers the
+// sender's node ID, returning the decoded RLP payload.
+func decodePacket(buf []byte) (packet interface{}, fromID NodeID, err error) {
+	if len(buf) < headSize+1 {
+		return nil, fromID, fmt.Errorf("packet too small")
+	}
+	hash, sig, sigdata := buf[:32], buf[32:headSize], buf[headSize:]
+	shouldhash := crypto.Keccak256(buf[32:])
+	if !equal(hash, shouldhash) {
+		return nil, fromID, fmt.Errorf("bad hash")
+	}
+	fromKey, err := crypto.SigToPub(crypto.Keccak256(sigdata), sig)
+	if err != nil {
+		return nil, fromID, err
+	}
+	fromID = PubkeyID(fromKey)
+
+	ptype := sigdata[0]
+	switch ptype {
+	case pingPacket:
+		var p ping
+		err = rlp.DecodeBytes(sigdata[1:], &p)
+		packet = &p
+	case pongPacket:
+		var p pong
+		err = rlp.DecodeBytes(sigdata[1:], &p)
+		packet = &p
+	case findnodePacket:
+		var p findnode
+		err = rlp.DecodeBytes(sigdata[1:], &p)
+		packet = &p
+	case neighborsPacket:
+		var p neighbors
+		err = rlp.DecodeBytes(sigdata[1:], &p)
+		packet = &p
+	default:
+		err = fmt.Errorf("unknown packet type %d", ptype)
+	}
+	return packet, fromID, err
+}
+
+func equal(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func futureExpiration() uint64 {
+	return uint64(time.Now().Add(20 * time.Second).Unix())
+}
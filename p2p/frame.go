@@ -0,0 +1,181 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// maxFrameSize bounds the length prefix read by readFrame, so a single
+// forged header can't make us allocate gigabytes before anything has been
+// authenticated.
+const maxFrameSize = 16 * 1024 * 1024
+
+// writeFrame/readFrame move a single blob across the wire behind a plain
+// 4-byte big-endian length prefix. They carry the handshake's auth and
+// auth-response packets and, afterwards, the ciphertext of every
+// rlpxFrameRW frame.
+func writeFrame(w io.Writer, data []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lenBuf[:])
+	if length > maxFrameSize {
+		return nil, fmt.Errorf("frame size %d exceeds maximum of %d", length, maxFrameSize)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// rlpxFrameRW is the post-handshake MsgReadWriter: every message is
+// AES-256-CTR encrypted with the session's aes-secret and authenticated by
+// rolling the egress/ingress Keccak256 MAC state over the ciphertext and
+// resealing it with mac-secret on every frame (see sealMAC).
+type rlpxFrameRW struct {
+	mu sync.Mutex
+
+	r *bufio.Reader
+	w io.Writer
+
+	enc cipher.Stream
+	dec cipher.Stream
+
+	macCipher  cipher.Block
+	egressMAC  hashState
+	ingressMAC hashState
+}
+
+// hashState is the minimal surface rlpxFrameRW needs from the running
+// Keccak256 MAC state produced by deriveSecrets.
+type hashState interface {
+	Write(p []byte) (int, error)
+	Sum(b []byte) []byte
+}
+
+func newRlpxFrameRW(r *bufio.Reader, w io.Writer, s secrets) *rlpxFrameRW {
+	// Both directions share one AES-256-CTR keystream seeded from a
+	// zero IV; the MAC (not the cipher) is what guards against replay
+	// and tampering here.
+	encBlock, _ := aes.NewCipher(s.AES)
+	decBlock, _ := aes.NewCipher(s.AES)
+	macBlock, _ := aes.NewCipher(s.MacSecret)
+	iv := make([]byte, aes.BlockSize)
+	return &rlpxFrameRW{
+		r:          r,
+		w:          w,
+		enc:        cipher.NewCTR(encBlock, iv),
+		dec:        cipher.NewCTR(decBlock, iv),
+		macCipher:  macBlock,
+		egressMAC:  s.EgressMAC,
+		ingressMAC: s.IngressMAC,
+	}
+}
+
+// sealMAC folds mac-secret-encrypted feedback of the running digest into
+// mac, XORed with the frame's ciphertext header, and returns the new tag.
+// Without this reseal step the MAC would degrade into a bare running hash
+// over attacker-controlled ciphertext; mac-secret is what keeps each tag
+// bound to a secret the attacker never sees.
+func sealMAC(mac hashState, block cipher.Block, header []byte) []byte {
+	seed := make([]byte, macLen)
+	block.Encrypt(seed, mac.Sum(nil)[:macLen])
+	for i := 0; i < len(header) && i < macLen; i++ {
+		seed[i] ^= header[i]
+	}
+	mac.Write(seed)
+	return mac.Sum(nil)[:macLen]
+}
+
+// frameHeaderLen is code(8) + size(4).
+const frameHeaderLen = 8 + 4
+const macLen = 16
+
+func (rw *rlpxFrameRW) WriteMsg(msg Msg) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, frameHeaderLen)
+	binary.BigEndian.PutUint64(header[:8], msg.Code)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(payload)))
+
+	plain := append(header, payload...)
+	ciphertext := make([]byte, len(plain))
+	rw.enc.XORKeyStream(ciphertext, plain)
+
+	rw.egressMAC.Write(ciphertext)
+	tag := sealMAC(rw.egressMAC, rw.macCipher, ciphertext[:frameHeaderLen])
+
+	if err := writeFrame(rw.w, ciphertext); err != nil {
+		return err
+	}
+	_, err = rw.w.Write(tag)
+	return err
+}
+
+func (rw *rlpxFrameRW) ReadMsg() (Msg, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	ciphertext, err := readFrame(rw.r)
+	if err != nil {
+		return Msg{}, err
+	}
+	tag := make([]byte, macLen)
+	if _, err := io.ReadFull(rw.r, tag); err != nil {
+		return Msg{}, err
+	}
+	rw.ingressMAC.Write(ciphertext)
+	expected := sealMAC(rw.ingressMAC, rw.macCipher, ciphertext[:frameHeaderLen])
+	if !bytesEqual(expected, tag) {
+		return Msg{}, fmt.Errorf("frame MAC mismatch")
+	}
+
+	plain := make([]byte, len(ciphertext))
+	rw.dec.XORKeyStream(plain, ciphertext)
+	if len(plain) < frameHeaderLen {
+		return Msg{}, fmt.Errorf("frame too short")
+	}
+	code := binary.BigEndian.Uint64(plain[:8])
+	size := binary.BigEndian.Uint32(plain[8:frameHeaderLen])
+	payload := plain[frameHeaderLen:]
+	if uint32(len(payload)) != size {
+		return Msg{}, fmt.Errorf("frame size mismatch: header says %d, got %d", size, len(payload))
+	}
+	return Msg{Code: code, Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}, nil
+}
+
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// TestFrameRoundTrip drives a pair of rlpxFrameRW over a connected pipe,
+// using the same secrets derivation both directions would end up with
+// after a real handshake, and checks that what one side writes, the other
+// side reads back intact and MAC-verified.
+func TestFrameRoundTrip(t *testing.T) {
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rand.Read(b)
+		return b
+	}
+	ephemeralShared := random(32)
+	initNonce := random(nonceLen)
+	respNonce := random(nonceLen)
+	authPkt := random(authMsgLen)
+	respPkt := random(authRespLen)
+
+	initSecrets := deriveSecrets(ephemeralShared, initNonce, respNonce, authPkt, respPkt, true)
+	respSecrets := deriveSecrets(ephemeralShared, initNonce, respNonce, authPkt, respPkt, false)
+
+	initConn, respConn := net.Pipe()
+	defer initConn.Close()
+	defer respConn.Close()
+
+	initRW := newRlpxFrameRW(bufio.NewReader(initConn), initConn, initSecrets)
+	respRW := newRlpxFrameRW(bufio.NewReader(respConn), respConn, respSecrets)
+
+	payload := []byte("frame round-trip payload")
+	writeDone := make(chan error, 1)
+	go func() {
+		writeDone <- initRW.WriteMsg(Msg{Code: 42, Size: uint32(len(payload)), Payload: bytes.NewReader(payload)})
+	}()
+
+	msg, err := respRW.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if err := <-writeDone; err != nil {
+		t.Fatalf("WriteMsg failed: %v", err)
+	}
+	if msg.Code != 42 {
+		t.Fatalf("msg.Code = %d, want 42", msg.Code)
+	}
+	got, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("payload mismatch: got %q, want %q", got, payload)
+	}
+}
+
+// TestFrameRoundTripMACMismatch checks that frames are rejected when the
+// two sides' MAC states diverge (e.g. a dropped frame), rather than being
+// silently accepted.
+func TestFrameRoundTripMACMismatch(t *testing.T) {
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rand.Read(b)
+		return b
+	}
+	ephemeralShared := random(32)
+	initNonce := random(nonceLen)
+	respNonce := random(nonceLen)
+	authPkt := random(authMsgLen)
+	respPkt := random(authRespLen)
+
+	initSecrets := deriveSecrets(ephemeralShared, initNonce, respNonce, authPkt, respPkt, true)
+	// Deriving the responder's secrets as "initiator" too desyncs its MAC
+	// seed from what the real initiator used, standing in for corruption
+	// or a dropped frame without needing to intercept bytes on the wire.
+	respSecrets := deriveSecrets(ephemeralShared, initNonce, respNonce, authPkt, respPkt, true)
+
+	initConn, respConn := net.Pipe()
+	defer initConn.Close()
+	defer respConn.Close()
+
+	initRW := newRlpxFrameRW(bufio.NewReader(initConn), initConn, initSecrets)
+	respRW := newRlpxFrameRW(bufio.NewReader(respConn), respConn, respSecrets)
+
+	payload := []byte("this frame must not verify against the wrong MAC state")
+	go initRW.WriteMsg(Msg{Code: 7, Size: uint32(len(payload)), Payload: bytes.NewReader(payload)})
+
+	if _, err := respRW.ReadMsg(); err == nil {
+		t.Fatal("expected frame MAC mismatch, got nil error")
+	}
+}
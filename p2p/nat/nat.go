@@ -0,0 +1,198 @@
+// Package nat provides access to common methods for port mapping and
+// discovery of a gateway's external IP address.
+package nat
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/logger"
+)
+
+// Interface is implemented by all NAT traversal methods.
+type Interface interface {
+	// ExternalIP returns the external IP address of the gateway device.
+	ExternalIP() (net.IP, error)
+	// AddMapping maps an external port to an internal port for the given
+	// protocol ("tcp" or "udp") so that external peers can connect in.
+	AddMapping(proto string, extport, intport int, name string, lifetime time.Duration) error
+	// DeleteMapping removes a previously added mapping.
+	DeleteMapping(proto string, extport, intport int) error
+	String() string
+}
+
+var natLogger = logger.NewLogger("NAT")
+
+// Map adds a port mapping on m and keeps it alive until c is closed. It is
+// intended to run in its own goroutine.
+func Map(m Interface, c chan struct{}, proto string, extport, intport int, name string) {
+	refresh := time.NewTimer(mapUpdateInterval)
+	defer refresh.Stop()
+	if err := m.AddMapping(proto, extport, intport, name, mapTimeout); err != nil {
+		natLogger.Warnf("network %s port mapping for %s failed: %v", proto, m, err)
+	}
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				m.DeleteMapping(proto, extport, intport)
+				return
+			}
+		case <-refresh.C:
+			if err := m.AddMapping(proto, extport, intport, name, mapTimeout); err != nil {
+				natLogger.Warnf("network %s port mapping refresh for %s failed: %v", proto, m, err)
+			}
+			refresh.Reset(mapUpdateInterval)
+		}
+	}
+}
+
+const (
+	mapTimeout        = 20 * time.Minute
+	mapUpdateInterval = 15 * time.Minute
+)
+
+// ExtIP implements Interface with a pre-determined, static external IP
+// address, e.g. because it was supplied via configuration and there is no
+// gateway to query.
+type ExtIP net.IP
+
+func (n ExtIP) ExternalIP() (net.IP, error) { return net.IP(n), nil }
+func (n ExtIP) String() string              { return fmt.Sprintf("ExtIP(%v)", net.IP(n)) }
+
+// These do nothing because the mapping is assumed to be static.
+func (ExtIP) AddMapping(string, int, int, string, time.Duration) error { return nil }
+func (ExtIP) DeleteMapping(string, int, int) error                     { return nil }
+
+// Parse parses a NAT interface description, as might be given with a CLI
+// flag. The following formats are accepted:
+//
+//	""            - no NAT mapping is performed
+//	"none"        - no NAT mapping is performed
+//	"extip:<IP>"  - the given IP is reported as the external address
+//	"any"         - the first auto-detected mechanism is used
+//	"upnp"        - UPnP IGD port mapping is used
+//	"pmp"         - NAT-PMP is used, auto-detecting the gateway
+func Parse(spec string) (Interface, error) {
+	var (
+		parts = strings.SplitN(spec, ":", 2)
+		mech  = strings.ToLower(parts[0])
+		ip    net.IP
+	)
+	if len(parts) > 1 {
+		ip = net.ParseIP(parts[1])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP in %q", spec)
+		}
+	}
+	switch mech {
+	case "", "none", "off":
+		return nil, nil
+	case "any", "auto", "on":
+		return Any(), nil
+	case "extip", "ip":
+		if ip == nil {
+			return nil, fmt.Errorf("missing IP address in %q", spec)
+		}
+		return ExtIP(ip), nil
+	case "upnp":
+		return UPnP(), nil
+	case "pmp", "natpmp", "nat-pmp":
+		return PMP(nil), nil
+	default:
+		return nil, fmt.Errorf("unknown mechanism %q", parts[0])
+	}
+}
+
+// Any returns a port mapper that tries to discover any supported mechanism
+// on the local network, preferring whichever one replies first.
+func Any() Interface {
+	return startautodisc("UPnP or NAT-PMP", func() Interface {
+		found := make(chan Interface, 2)
+		go func() { found <- discoverUPnP() }()
+		go func() { found <- discoverPMP() }()
+		for i := 0; i < cap(found); i++ {
+			if c := <-found; c != nil {
+				return c
+			}
+		}
+		return nil
+	})
+}
+
+// UPnP returns a port mapper that uses UPnP IGD-style port mapping. It
+// returns immediately; discovery runs on the first method call, which
+// blocks until a gateway device has been found or discovery fails.
+func UPnP() Interface {
+	return startautodisc("UPnP", discoverUPnP)
+}
+
+// PMP returns a port mapper that uses NAT-PMP. If gw is nil, the router is
+// auto-detected.
+func PMP(gw net.IP) Interface {
+	if gw != nil {
+		return &pmp{gw: gw}
+	}
+	return startautodisc("NAT-PMP", discoverPMP)
+}
+
+// autodisc represents a port mapping mechanism that is still being
+// searched for. Calls block until discovery has completed.
+type autodisc struct {
+	what string
+	once sync.Once
+	doit func() Interface
+
+	mu    sync.Mutex
+	found Interface
+}
+
+func startautodisc(what string, doit func() Interface) Interface {
+	return &autodisc{what: what, doit: doit}
+}
+
+func (n *autodisc) ExternalIP() (net.IP, error) {
+	if err := n.wait(); err != nil {
+		return nil, err
+	}
+	return n.found.ExternalIP()
+}
+
+func (n *autodisc) AddMapping(proto string, extport, intport int, name string, lifetime time.Duration) error {
+	if err := n.wait(); err != nil {
+		return err
+	}
+	return n.found.AddMapping(proto, extport, intport, name, lifetime)
+}
+
+func (n *autodisc) DeleteMapping(proto string, extport, intport int) error {
+	if err := n.wait(); err != nil {
+		return err
+	}
+	return n.found.DeleteMapping(proto, extport, intport)
+}
+
+func (n *autodisc) String() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.found == nil {
+		return n.what
+	}
+	return n.found.String()
+}
+
+func (n *autodisc) wait() error {
+	n.once.Do(func() {
+		found := n.doit()
+		n.mu.Lock()
+		n.found = found
+		n.mu.Unlock()
+	})
+	if n.found == nil {
+		return fmt.Errorf("no %s router discovered", n.what)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package nat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// pmp implements Interface using NAT-PMP (RFC 6886).
+type pmp struct {
+	gw net.IP
+}
+
+// opcodes, per RFC 6886 section 3.
+const (
+	opExternalAddr = 0
+	opMapUDP       = 1
+	opMapTCP       = 2
+)
+
+const pmpPort = 5351
+
+func discoverPMP() Interface {
+	gw, err := defaultGateway()
+	if err != nil {
+		return nil
+	}
+	candidate := &pmp{gw: gw}
+	if _, err := candidate.ExternalIP(); err != nil {
+		return nil
+	}
+	return candidate
+}
+
+// defaultGateway guesses the router's address from the host's own network
+// configuration: the .1 address of the first non-loopback IPv4 interface,
+// which holds for the overwhelming majority of home and office networks.
+// NAT-PMP has no discovery phase of its own, unlike UPnP's SSDP.
+func defaultGateway() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		ip4 := ipnet.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		gw := make(net.IP, 4)
+		copy(gw, ip4)
+		gw[3] = 1
+		return gw, nil
+	}
+	return nil, errors.New("no suitable network interface found")
+}
+
+func (n *pmp) rpc(op byte, req []byte, respLen int) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(n.gw.String(), fmt.Sprintf("%d", pmpPort)), 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, respLen)
+	nr, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	if nr < respLen {
+		return nil, fmt.Errorf("short NAT-PMP response (%d bytes)", nr)
+	}
+	if resp[1] != op+128 {
+		return nil, fmt.Errorf("unexpected NAT-PMP opcode %d in response", resp[1])
+	}
+	if code := uint16(resp[2])<<8 | uint16(resp[3]); code != 0 {
+		return nil, fmt.Errorf("NAT-PMP error code %d", code)
+	}
+	return resp, nil
+}
+
+func (n *pmp) ExternalIP() (net.IP, error) {
+	resp, err := n.rpc(opExternalAddr, []byte{0, opExternalAddr}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (n *pmp) AddMapping(proto string, extport, intport int, name string, lifetime time.Duration) error {
+	op := byte(opMapUDP)
+	if proto == "tcp" {
+		op = opMapTCP
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	putUint16(req[4:6], uint16(intport))
+	putUint16(req[6:8], uint16(extport))
+	putUint32(req[8:12], uint32(lifetime/time.Second))
+	_, err := n.rpc(op, req, 16)
+	return err
+}
+
+func (n *pmp) DeleteMapping(proto string, extport, intport int) error {
+	// Per RFC 6886 section 3.4, a mapping is deleted by requesting it
+	// again with an external port and lifetime of zero.
+	return n.AddMapping(proto, 0, intport, "", 0)
+}
+
+func (n *pmp) String() string {
+	return fmt.Sprintf("NAT-PMP(%v)", n.gw)
+}
+
+func putUint16(b []byte, v uint16) { b[0] = byte(v >> 8); b[1] = byte(v) }
+
+func putUint32(b []byte, v uint32) {
+	b[0] = byte(v >> 24)
+	b[1] = byte(v >> 16)
+	b[2] = byte(v >> 8)
+	b[3] = byte(v)
+}
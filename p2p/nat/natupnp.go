@@ -0,0 +1,274 @@
+package nat
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// upnp implements Interface using a UPnP IGD (Internet Gateway Device),
+// found via SSDP discovery and driven by SOAP calls against its
+// WANIPConnection or WANPPPConnection service.
+type upnp struct {
+	device     string
+	serviceURL string
+	serviceNS  string
+}
+
+const (
+	ssdpAddr = "239.255.255.250:1900"
+	ssdpMx   = 2 // seconds, per the SSDP spec
+)
+
+// wanServices are the IGD service types that expose port mapping, tried in
+// order of preference (IGDv2 first).
+var wanServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+func discoverUPnP() Interface {
+	loc, err := discoverSSDP()
+	if err != nil {
+		return nil
+	}
+	root, err := fetchDeviceDesc(loc)
+	if err != nil {
+		return nil
+	}
+	for _, ns := range wanServices {
+		if svc := root.findService(ns); svc != "" {
+			return &upnp{device: loc, serviceURL: resolveURL(loc, svc), serviceNS: ns}
+		}
+	}
+	return nil
+}
+
+// discoverSSDP sends an SSDP M-SEARCH for InternetGatewayDevice and returns
+// the LOCATION header of the first device that answers.
+func discoverSSDP() (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		fmt.Sprintf("MX: %d\r\n\r\n", ssdpMx)
+
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.WriteTo([]byte(req), dst); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add((ssdpMx + 1) * time.Second))
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", err
+		}
+		if loc := parseLocation(buf[:n]); loc != "" {
+			return loc, nil
+		}
+	}
+}
+
+func parseLocation(resp []byte) string {
+	for _, line := range strings.Split(string(resp), "\r\n") {
+		if i := strings.IndexByte(line, ':'); i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), "LOCATION") {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+// deviceDesc is a partial parse of a UPnP device description document, deep
+// enough to locate a service's control URL by service type.
+type deviceDesc struct {
+	XMLName xml.Name `xml:"root"`
+	Device  device   `xml:"device"`
+}
+
+type device struct {
+	DeviceList struct {
+		Device []device `xml:"device"`
+	} `xml:"deviceList"`
+	ServiceList struct {
+		Service []struct {
+			ServiceType string `xml:"serviceType"`
+			ControlURL  string `xml:"controlURL"`
+		} `xml:"service"`
+	} `xml:"serviceList"`
+}
+
+func fetchDeviceDesc(loc string) (*deviceDesc, error) {
+	resp, err := http.Get(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var root deviceDesc
+	if err := xml.Unmarshal(body, &root); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// findService walks the device tree for a service of the given type and
+// returns its (possibly relative) control URL.
+func (d *deviceDesc) findService(serviceType string) string {
+	return d.Device.findService(serviceType)
+}
+
+func (d *device) findService(serviceType string) string {
+	for _, s := range d.ServiceList.Service {
+		if s.ServiceType == serviceType {
+			return s.ControlURL
+		}
+	}
+	for i := range d.DeviceList.Device {
+		if u := d.DeviceList.Device[i].findService(serviceType); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+func resolveURL(loc, ref string) string {
+	base, err := url.Parse(loc)
+	if err != nil {
+		return ref
+	}
+	rel, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(rel).String()
+}
+
+// soapCall issues a SOAP action against the device's control URL and
+// returns the raw XML of the response body.
+func (n *upnp) soapCall(action string, args map[string]string) ([]byte, error) {
+	var argsXML bytes.Buffer
+	for k, v := range args {
+		fmt.Fprintf(&argsXML, "<%s>%s</%s>", k, v, k)
+	}
+	envelope := fmt.Sprintf(`<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%s xmlns:u="%s">%s</u:%s></s:Body></s:Envelope>`, action, n.serviceNS, argsXML.String(), action)
+
+	req, err := http.NewRequest("POST", n.serviceURL, bytes.NewReader([]byte(envelope)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, n.serviceNS, action))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("SOAP action %s failed: %s", action, resp.Status)
+	}
+	return body, nil
+}
+
+// extractXMLValue is a pragmatic stand-in for full SOAP response parsing:
+// IGD responses are flat, so a plain substring search for <tag>value</tag>
+// is enough without pulling in namespace-aware unmarshalling.
+func extractXMLValue(body []byte, tag string) (string, bool) {
+	open, close := "<"+tag+">", "</"+tag+">"
+	i := bytes.Index(body, []byte(open))
+	if i < 0 {
+		return "", false
+	}
+	i += len(open)
+	j := bytes.Index(body[i:], []byte(close))
+	if j < 0 {
+		return "", false
+	}
+	return string(body[i : i+j]), true
+}
+
+func (n *upnp) ExternalIP() (net.IP, error) {
+	resp, err := n.soapCall("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := extractXMLValue(resp, "NewExternalIPAddress")
+	if !ok {
+		return nil, fmt.Errorf("no NewExternalIPAddress in response")
+	}
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid external IP %q", v)
+	}
+	return ip, nil
+}
+
+func (n *upnp) AddMapping(proto string, extport, intport int, name string, lifetime time.Duration) error {
+	_, err := n.soapCall("AddPortMapping", map[string]string{
+		"NewRemoteHost":             "",
+		"NewExternalPort":           fmt.Sprintf("%d", extport),
+		"NewProtocol":               strings.ToUpper(proto),
+		"NewInternalPort":           fmt.Sprintf("%d", intport),
+		"NewInternalClient":         localAddrFor(n.serviceURL),
+		"NewEnabled":                "1",
+		"NewPortMappingDescription": name,
+		"NewLeaseDuration":          fmt.Sprintf("%d", int(lifetime/time.Second)),
+	})
+	return err
+}
+
+func (n *upnp) DeleteMapping(proto string, extport, intport int) error {
+	_, err := n.soapCall("DeletePortMapping", map[string]string{
+		"NewRemoteHost":   "",
+		"NewExternalPort": fmt.Sprintf("%d", extport),
+		"NewProtocol":     strings.ToUpper(proto),
+	})
+	return err
+}
+
+func (n *upnp) String() string {
+	return fmt.Sprintf("UPnP(%s)", n.device)
+}
+
+// localAddrFor dials the gateway to learn which local address routes to it,
+// which is what IGD expects as NewInternalClient.
+func localAddrFor(serviceURL string) string {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return ""
+	}
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	return host
+}
@@ -3,7 +3,7 @@ package p2p
 import (
 	"bufio"
 	"bytes"
-	"crypto/rand"
+	"crypto/ecdsa"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -13,24 +13,25 @@ import (
 
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/p2p/discover"
 )
 
 // peerAddr is the structure of a peer list element.
 // It is also a valid net.Addr.
 type peerAddr struct {
-	IP     net.IP
-	Port   uint64
-	Pubkey []byte // optional
+	IP   net.IP
+	Port uint64
+	ID   discover.NodeID // optional, the peer's node ID as known via discovery
 }
 
-func newPeerAddr(addr net.Addr, pubkey []byte) *peerAddr {
+func newPeerAddr(addr net.Addr, id discover.NodeID) *peerAddr {
 	n := addr.Network()
 	if n != "tcp" && n != "tcp4" && n != "tcp6" {
 		// for testing with non-TCP
-		return &peerAddr{net.ParseIP("127.0.0.1"), 30303, pubkey}
+		return &peerAddr{net.ParseIP("127.0.0.1"), 30303, id}
 	}
 	ta := addr.(*net.TCPAddr)
-	return &peerAddr{ta.IP, uint64(ta.Port), pubkey}
+	return &peerAddr{ta.IP, uint64(ta.Port), id}
 }
 
 func (d peerAddr) Network() string {
@@ -46,7 +47,7 @@ func (d peerAddr) String() string {
 }
 
 func (d *peerAddr) RlpData() interface{} {
-	return []interface{}{string(d.IP), d.Port, d.Pubkey}
+	return []interface{}{string(d.IP), d.Port, d.ID[:]}
 }
 
 // Peer represents a remote peer.
@@ -56,7 +57,7 @@ type Peer struct {
 	*logger.Logger
 
 	infolock   sync.Mutex
-	identity   ClientIdentity
+	id         discover.NodeID // node ID of the remote peer, set once the handshake completes
 	caps       []Cap
 	listenAddr *peerAddr // what remote peer is listening on
 	dialAddr   *peerAddr // non-nil if dialing
@@ -68,6 +69,7 @@ type Peer struct {
 	protocols       []Protocol
 	runBaseProtocol bool       // for testing
 	CryptoType      CryptoType //
+	allowInsecure   bool       // for testing only, permits CryptoType == NoCrypto
 	cryptoReady     chan struct{}
 
 	runlock sync.RWMutex // protects running
@@ -84,37 +86,43 @@ type Peer struct {
 
 	// These fields are kept so base protocol can access them.
 	// TODO: this should be one or more interfaces
-	ourID         ClientIdentity        // client id of the Server
-	ourListenAddr *peerAddr             // listen addr of Server, nil if not listening
-	newPeerAddr   chan<- *peerAddr      // tell server about received peers
-	otherPeers    func() []*Peer        // should return the list of all peers
-	pubkeyHook    func(*peerAddr) error // called at end of handshake to validate pubkey
+	ourID         discover.NodeID              // node ID of the Server
+	ourPrivKey    *ecdsa.PrivateKey            // private key of the Server, used for the crypto handshake
+	ourListenAddr *peerAddr                    // listen addr of Server, nil if not listening
+	newPeerAddr   chan<- *peerAddr             // tell server about received peers
+	otherPeers    func() []*Peer               // should return the list of all peers
+	verifyID      func(*peerAddr) error        // checks the remote's NodeID against the discovery table
+	onConnected   func(discover.NodeID, *Peer) // registers the peer with the server once its NodeID is verified
+	onDisconnect  func(*Peer)                  // deregisters the peer from the server, however the connection ended
 }
 
-// NewPeer returns a peer for testing purposes.
-func NewPeer(id ClientIdentity, caps []Cap) *Peer {
+// NewPeer returns a peer for testing purposes. Unlike a peer created by the
+// Server, it runs without the RLPx crypto handshake, so it must only be
+// used in tests.
+func NewPeer(id discover.NodeID, caps []Cap) *Peer {
 	conn, _ := net.Pipe()
 	peer := newPeer(conn, nil, nil)
 	peer.setHandshakeInfo(id, nil, caps)
+	peer.allowInsecure = true
 	close(peer.closed)
 	return peer
 }
 
 func newServerPeer(server *Server, conn net.Conn, dialAddr *peerAddr) *Peer {
 	p := newPeer(conn, server.Protocols, dialAddr)
-	p.ourID = server.Identity
-	p.newPeerAddr = server.peerConnect
+	p.ourID = discover.PubkeyID(&server.PrivateKey.PublicKey)
+	p.ourPrivKey = server.PrivateKey
 	p.otherPeers = server.Peers
-	p.pubkeyHook = server.verifyPeer
+	p.verifyID = server.verifyPeer
+	p.onConnected = server.peerConnected
+	p.onDisconnect = server.removePeer
 	p.runBaseProtocol = true
-	if server.Encryption {
-		p.CryptoType = EthCrypto
-	}
+	p.CryptoType = EthCrypto
 
 	// laddr can be updated concurrently by NAT traversal.
 	// newServerPeer must be called with the server lock held.
 	if server.laddr != nil {
-		p.ourListenAddr = newPeerAddr(server.laddr, server.Identity.PublicKey())
+		p.ourListenAddr = newPeerAddr(server.laddr, p.ourID)
 	}
 	return p
 }
@@ -134,25 +142,24 @@ func newPeer(conn net.Conn, protocols []Protocol, dialAddr *peerAddr) *Peer {
 	return p
 }
 
-// Identity returns the client identity of the remote peer. The
-// identity can be nil if the peer has not yet completed the
-// handshake.
-func (p *Peer) Identity() ClientIdentity {
+// Identity returns the node ID of the remote peer. The ID is the zero
+// value if the peer has not yet completed the handshake.
+func (p *Peer) Identity() discover.NodeID {
 	p.infolock.Lock()
 	defer p.infolock.Unlock()
-	return p.identity
+	return p.id
 }
 
 func (self *Peer) PublicKey() (pubkey []byte) {
 	self.infolock.Lock()
 	defer self.infolock.Unlock()
 	switch {
-	case self.identity != nil:
-		pubkey = self.identity.PublicKey()[1:]
+	case self.id != (discover.NodeID{}):
+		pubkey = self.id[:]
 	case self.dialAddr != nil:
-		pubkey = self.dialAddr.Pubkey
+		pubkey = self.dialAddr.ID[:]
 	case self.listenAddr != nil:
-		pubkey = self.listenAddr.Pubkey
+		pubkey = self.listenAddr.ID[:]
 	}
 	return
 }
@@ -164,9 +171,9 @@ func (p *Peer) Caps() []Cap {
 	return p.caps
 }
 
-func (p *Peer) setHandshakeInfo(id ClientIdentity, laddr *peerAddr, caps []Cap) {
+func (p *Peer) setHandshakeInfo(id discover.NodeID, laddr *peerAddr, caps []Cap) {
 	p.infolock.Lock()
-	p.identity = id
+	p.id = id
 	p.listenAddr = laddr
 	p.caps = caps
 	p.infolock.Unlock()
@@ -212,6 +219,15 @@ func (p *Peer) loop() (reason DiscReason, err error) {
 	defer p.closeProtocols()
 	defer close(p.closed)
 	defer p.conn.Close()
+	defer func() {
+		// Deregister however the connection ended, including a handshake
+		// that failed before the peer was ever fully connected: it was
+		// still appended to srv.peers as soon as the TCP connection came
+		// in, so it must be removed again regardless.
+		if p.onDisconnect != nil {
+			p.onDisconnect(p)
+		}
+	}()
 
 	if err = p.handleCryptoHandshake(); err != nil {
 		// from here on everything can be encrypted, authenticated
@@ -321,36 +337,48 @@ func (p *Peer) handleCryptoHandshake() (err error) {
 	var crw MsgReadWriter
 	switch p.CryptoType {
 	case NoCrypto:
+		if !p.allowInsecure {
+			err = fmt.Errorf("refusing insecure connection: NoCrypto is for tests only")
+			p.Errorf("%v", err)
+			return
+		}
 		if crw, err = NewMsgRW(bufio.NewReader(p.conn), p.conn); err != nil {
 			return
 		}
 		p.Infof("insecure connection using no encryption/authentication")
 
 	case EthCrypto:
-		// cryptoId is just created for the lifecycle of the handshake
-		// it is survived by an encrypted readwriter
-		var initiator bool
-		var sessionToken []byte
-		sessionToken = make([]byte, keyLen)
-		if _, err = rand.Read(sessionToken); err != nil {
-			return
-		}
-		if p.dialAddr != nil { // this should have its own method Outgoing() bool
-			initiator = true
-		}
-		// create crypto layer
-		// this could in principle run only once but maybe we want to allow
-		// identity switching
+		// cryptoId is just created for the lifecycle of the handshake;
+		// it is survived by an encrypted readwriter.
+		initiator := p.dialAddr != nil // this should have its own method Outgoing() bool
+
 		var crypto *cryptoId
-		if crypto, err = newCryptoId(p.ourID); err != nil {
+		if crypto, err = newCryptoId(p.ourPrivKey); err != nil {
 			return
 		}
-		// run on peer
-		// this bit handles the handshake and creates a secure communications channel with
-		if sessionToken, crw, err = crypto.NewSession(bufio.NewReader(p.conn), p.conn, p.PublicKey(), sessionToken, initiator); err != nil {
+		// run the RLPx authenticated handshake and obtain a secure,
+		// framed readwriter for everything that follows.
+		if crw, err = crypto.NewSession(bufio.NewReader(p.conn), p.conn, p.PublicKey(), initiator); err != nil {
 			p.Errorf("unable to setup secure session: %v", err)
 			return
 		}
+		// For outbound connections we already know which NodeID we dialed,
+		// so verify it against the discovery table right away and register
+		// the peer under that verified ID. Inbound connections are not
+		// checked with verifyID or registered with onConnected here, and
+		// startBaseProtocol does not do either.
+		if p.dialAddr != nil {
+			if p.verifyID != nil {
+				if err = p.verifyID(p.dialAddr); err != nil {
+					p.Errorf("identity verification failed: %v", err)
+					return
+				}
+			}
+			p.setHandshakeInfo(p.dialAddr.ID, nil, nil)
+			if p.onConnected != nil {
+				p.onConnected(p.dialAddr.ID, p)
+			}
+		}
 	default:
 		err = fmt.Errorf("unrecognised crypto type %v", p.CryptoType)
 		p.Errorf("%v", err)
@@ -0,0 +1,248 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/nat"
+)
+
+// Server manages all peer connections.
+type Server struct {
+	// PrivateKey is the Server's identity key. It is used to sign
+	// discovery packets and as the static key in the RLPx crypto
+	// handshake. It must be set.
+	PrivateKey *ecdsa.PrivateKey
+
+	// MaxPeers is the maximum number of peers that can be connected. If
+	// zero, the limit is disabled.
+	MaxPeers int
+
+	// Protocols should contain the protocols supported by the server.
+	Protocols []Protocol
+
+	// ListenAddr is the address that the server listens on for incoming
+	// TCP connections. If it is empty, the server accepts no inbound
+	// connections and only dials peers taken from the discovery table.
+	ListenAddr string
+
+	// BootstrapNodes are used to establish connectivity with the rest of
+	// the network when the discovery table is empty.
+	BootstrapNodes []*discover.Node
+
+	// NAT punches port mappings for ListenAddr through routers that
+	// support it. It may be nil, in which case no NAT traversal is
+	// attempted and laddr is published as-is.
+	NAT nat.Interface
+
+	lock     sync.Mutex
+	running  bool
+	laddr    net.Addr // listen address, may be updated by NAT traversal
+	listener net.Listener
+
+	ntab *discover.Table
+
+	peers   []*Peer
+	peerMap map[discover.NodeID]*Peer
+
+	peerConnect chan<- *peerAddr
+
+	quit   chan struct{}
+	loopWG sync.WaitGroup
+
+	logger *logger.Logger
+}
+
+// Start starts the server, opening the configured listener (if any),
+// bootstrapping the discovery table and entering the dial loop.
+func (srv *Server) Start() error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.running {
+		return fmt.Errorf("server already running")
+	}
+	if srv.PrivateKey == nil {
+		return fmt.Errorf("Server.PrivateKey must be set")
+	}
+	srv.logger = logger.NewLogger("P2P SERVER")
+	srv.quit = make(chan struct{})
+	srv.peerMap = make(map[discover.NodeID]*Peer)
+
+	if srv.ListenAddr != "" {
+		listener, err := net.Listen("tcp", srv.ListenAddr)
+		if err != nil {
+			return err
+		}
+		srv.listener = listener
+		srv.laddr = listener.Addr()
+		go srv.listenLoop()
+
+		if srv.NAT != nil {
+			srv.loopWG.Add(1)
+			go srv.natLoop()
+		}
+	}
+
+	ntab, err := discover.ListenUDP(srv.PrivateKey, srv.ListenAddr, srv.NAT)
+	if err != nil {
+		return err
+	}
+	srv.ntab = ntab
+	ntab.Bootstrap(srv.BootstrapNodes)
+
+	srv.running = true
+	srv.loopWG.Add(1)
+	go srv.dialLoop()
+	return nil
+}
+
+// Stop terminates the server: it closes the listener and waits for the
+// dial and NAT loops to exit. Peers that are already connected are not
+// disconnected.
+func (srv *Server) Stop() {
+	srv.lock.Lock()
+	if !srv.running {
+		srv.lock.Unlock()
+		return
+	}
+	srv.running = false
+	close(srv.quit)
+	if srv.listener != nil {
+		srv.listener.Close()
+	}
+	srv.lock.Unlock()
+	srv.loopWG.Wait()
+}
+
+func (srv *Server) listenLoop() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		go srv.addPeer(conn, nil)
+	}
+}
+
+// natLoop resolves the external IP address through srv.NAT, publishes it in
+// srv.laddr so that newly connecting peers are told the reachable endpoint
+// instead of the internal one, and keeps the TCP port mapping alive for as
+// long as the server runs.
+func (srv *Server) natLoop() {
+	defer srv.loopWG.Done()
+	tcpAddr, ok := srv.laddr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	if ip, err := srv.NAT.ExternalIP(); err != nil {
+		srv.logger.Warnf("could not resolve external IP via %v: %v", srv.NAT, err)
+	} else {
+		srv.lock.Lock()
+		srv.laddr = &net.TCPAddr{IP: ip, Port: tcpAddr.Port}
+		srv.lock.Unlock()
+	}
+	nat.Map(srv.NAT, srv.quit, "tcp", tcpAddr.Port, tcpAddr.Port, "ethereum p2p")
+}
+
+// dialLoop continuously pulls peering candidates from the discovery table
+// and dials them, instead of relying on a static configured peer list.
+func (srv *Server) dialLoop() {
+	defer srv.loopWG.Done()
+	refresh := time.NewTicker(5 * time.Second)
+	defer refresh.Stop()
+	for {
+		select {
+		case <-srv.quit:
+			return
+		case <-refresh.C:
+			if srv.MaxPeers > 0 && srv.PeerCount() >= srv.MaxPeers {
+				continue
+			}
+			n := srv.ntab.Random()
+			if n == nil {
+				continue
+			}
+			go srv.dial(n)
+		}
+	}
+}
+
+func (srv *Server) dial(n *discover.Node) {
+	addr := &net.TCPAddr{IP: n.IP, Port: int(n.TCPPort)}
+	conn, err := net.DialTimeout("tcp", addr.String(), 5*time.Second)
+	if err != nil {
+		srv.logger.Warnf("dial error to %v: %v", n, err)
+		return
+	}
+	srv.addPeer(conn, newPeerAddr(addr, n.ID))
+}
+
+func (srv *Server) addPeer(conn net.Conn, dialAddr *peerAddr) {
+	srv.lock.Lock()
+	peer := newServerPeer(srv, conn, dialAddr)
+	srv.peers = append(srv.peers, peer)
+	srv.lock.Unlock()
+	peer.loop()
+}
+
+// Peers returns all connected peers.
+func (srv *Server) Peers() []*Peer {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	list := make([]*Peer, len(srv.peers))
+	copy(list, srv.peers)
+	return list
+}
+
+// PeerCount returns the number of connected peers.
+func (srv *Server) PeerCount() int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return len(srv.peers)
+}
+
+// peerConnected is called by a Peer once it has completed the discovery
+// verification, registering it under its verified NodeID.
+func (srv *Server) peerConnected(id discover.NodeID, p *Peer) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.peerMap[id] = p
+}
+
+// removePeer deregisters p, however its connection ended: a handshake
+// failure, a graceful disconnect, or the wire just dropping. It is called
+// once per peer.loop(), so every entry addPeer/peerConnected created is
+// cleaned up and PeerCount (and therefore the MaxPeers gate in dialLoop)
+// reflects only peers that are actually still connected.
+func (srv *Server) removePeer(p *Peer) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for i, peer := range srv.peers {
+		if peer == p {
+			srv.peers = append(srv.peers[:i], srv.peers[i+1:]...)
+			break
+		}
+	}
+	if id := p.Identity(); srv.peerMap[id] == p {
+		delete(srv.peerMap, id)
+	}
+}
+
+// verifyPeer checks that addr's NodeID is known to the discovery table,
+// replacing the old pubkeyHook mechanism.
+func (srv *Server) verifyPeer(addr *peerAddr) error {
+	if srv.ntab == nil {
+		return nil
+	}
+	for _, n := range srv.ntab.Closest(addr.ID, 1) {
+		if n.ID == addr.ID {
+			return nil
+		}
+	}
+	return fmt.Errorf("remote node id %x not found via discovery", addr.ID[:8])
+}
@@ -3,26 +3,23 @@ package main
 //@NOTE SHYFT main func for api, sets up router and spins up a server
 //to run server 'go run shyftRingWalletConn/*.go'
 import (
-	"bufio"
+	"context"
 	"fmt"
+	"github.com/ShyftNetwork/go-empyrean/common"
 	"github.com/ShyftNetwork/go-empyrean/common/hexutil"
 	"github.com/ShyftNetwork/go-empyrean/crypto"
+	"github.com/ShyftNetwork/go-empyrean/crypto/ring"
+	"github.com/ShyftNetwork/go-empyrean/ethclient"
 	"io"
 	"net"
 	"net/http"
 	"os"
-	"github.com/ShyftNetwork/go-empyrean/ethclient"
-	"github.com/ShyftNetwork/go-empyrean/common"
-	"context"
-	"time"
-	"sync"
 )
 
 const (
-	CONN_HOST     = "localhost"
-	CONN_PORT     = "3333"
-	CONN_TYPE     = "tcp"
-	NEW_LINE_BYTE = 0x0a
+	CONN_HOST = "localhost"
+	CONN_PORT = "3333"
+	CONN_TYPE = "tcp"
 )
 
 var testAddrHex = "14791697260E4c9A71f18484C9f997B308e59325"
@@ -30,8 +27,6 @@ var testPrivHex = "0123456789012345678901234567890123456789012345678901234567890
 
 var client = &http.Client{}
 
-var mutex = &sync.Mutex{}
-
 // This gives context to the signed message and prevents signing of transactions.
 func signHash(data []byte) []byte {
 	msg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(data), data)
@@ -58,163 +53,141 @@ func main() {
 	}
 }
 
-// Handles incoming requests.
-func handleRequest(conn net.Conn) {
-
-	messages := make(chan []byte)
-	checkBalanceChan := make(chan []byte)
-
-	go readerConn(conn, messages)
-	go handleMessages(messages, checkBalanceChan)
-	go checkBalance(checkBalanceChan, conn)
+// clientState holds the per-connection fields that used to be the globals
+// in handleMessages. They accumulate across frames until there's enough to
+// recover and log the signer's address.
+type clientState struct {
+	address   []byte
+	signature []byte
+	message   []byte
+}
 
-	sendRingSignedMsg(conn)
+// frameHandlers dispatches an incoming frame to its handler by type,
+// replacing the old header-on-previous-line convention.
+var frameHandlers = map[byte]func(wc *walletConn, state *clientState, payload []byte){
+	MsgAddress:    handleAddressFrame,
+	MsgGetBalance: handleGetBalanceFrame,
+	MsgSignature:  handleSignatureFrame,
+	MsgMessage:    handleMessageFrame,
 }
 
-func handleMessages(channel chan []byte, checkBalancesChan chan []byte) {
-	var prevMsg []byte
-	var addressOfClient []byte
-	var signatureFromClient []byte
-	var msgFromClient []byte
+// Handles incoming requests.
+func handleRequest(conn net.Conn) {
+	wc := newWalletConn(conn)
+	state := &clientState{}
+
+	go sendRingSignedMsg(wc)
 
 	for {
-		msg := <-channel
-
-		//similar to shift in bash
-		if prevMsg != nil {
-			s := string(prevMsg[:])
-			if s == "-- ADDRESS --" {
-				fmt.Println("putting on channel 1")
-				addressOfClient = msg
-				checkBalancesChan <- addressOfClient
-			}
-			if s == "-- GET_BALANCE --" {
-				fmt.Println("putting on channel 3")
-				checkBalancesChan <- msg
-			}
-			if s == "-- SIGNATURE --" {
-				signatureFromClient = msg
-			}
-			if s == "-- MESSAGE --" {
-				msgFromClient = msg
-			}
-			prevMsg = nil
-		} else {
-			prevMsg = msg
+		msgType, payload, err := wc.ReadFrame()
+		if err == io.EOF {
+			fmt.Println("END OF FILE, CLOSING CONNECTION")
+			wc.Close()
+			return
+		}
+		if err != nil {
+			fmt.Println("Connection error: ", err)
+			wc.Close()
+			return
 		}
 
-		if addressOfClient != nil && signatureFromClient != nil && msgFromClient != nil {
-			sig := string(signatureFromClient[:])
-			var sigByteArr, error = hexutil.Decode(sig)
-
-			if error != nil {
-				fmt.Println(error)
-			}
-
-			var sigHex = hexutil.Bytes(sigByteArr)
-			sigHex[64] -= 27
-
-			signedMsgHash := signHash(msgFromClient)
-
-			var rpk, err = crypto.Ecrecover(signedMsgHash, sigHex)
-			if err != nil {
-				fmt.Println(err)
-			}
-
-			pubKey := crypto.ToECDSAPub(rpk)
-			recoveredAddr := crypto.PubkeyToAddress(*pubKey)
-			fmt.Println("ADDRESS IS ::", recoveredAddr.Hex())
-			signatureFromClient = nil
-			msgFromClient = nil
+		handler, ok := frameHandlers[msgType]
+		if !ok {
+			fmt.Println("unknown frame type:", msgType)
+			continue
 		}
+		handler(wc, state, payload)
 	}
 }
 
-func readerConn(conn net.Conn, channel chan []byte) {
-	bufReader := bufio.NewReader(conn)
+func handleAddressFrame(wc *walletConn, state *clientState, payload []byte) {
+	state.address = payload
+	checkBalance(wc, payload)
+}
 
-	for {
-		msg, err := bufReader.ReadBytes(NEW_LINE_BYTE)
+func handleGetBalanceFrame(wc *walletConn, state *clientState, payload []byte) {
+	checkBalance(wc, payload)
+}
 
-		if err == io.EOF {
-			fmt.Println("END OF FILE, CLOSING CONNECTION")
-			conn.Close()
-			conn = nil
-			break
-		}
-		if err != nil {
-			fmt.Println("Connection error: ", err)
-			break
-		}
+func handleSignatureFrame(wc *walletConn, state *clientState, payload []byte) {
+	state.signature = payload
+	tryRecoverSigner(state)
+}
+
+func handleMessageFrame(wc *walletConn, state *clientState, payload []byte) {
+	state.message = payload
+	tryRecoverSigner(state)
+}
 
-		msg = msg[:len(msg)-1] // remove trailing new line byte
+// tryRecoverSigner recovers and logs the address that produced
+// state.signature over state.message, once both have arrived.
+func tryRecoverSigner(state *clientState) {
+	if state.address == nil || state.signature == nil || state.message == nil {
+		return
+	}
+	sigByteArr, err := hexutil.Decode(string(state.signature))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	sigHex := hexutil.Bytes(sigByteArr)
+	sigHex[64] -= 27
 
-		channel <- msg
+	signedMsgHash := signHash(state.message)
+	rpk, err := crypto.Ecrecover(signedMsgHash, sigHex)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+
+	pubKey := crypto.ToECDSAPub(rpk)
+	recoveredAddr := crypto.PubkeyToAddress(*pubKey)
+	fmt.Println("ADDRESS IS ::", recoveredAddr.Hex())
+
+	state.signature = nil
+	state.message = nil
 }
 
-func checkBalance(checkBalanceChan chan []byte, conn net.Conn) {
+func checkBalance(wc *walletConn, address []byte) {
 	fmt.Println("in check balance function")
 	c, err := ethclient.Dial("http://127.0.0.1:8545")
 	if err != nil {
-		fmt.Println("Eth Client not initialized: " , err)
+		fmt.Println("Eth Client not initialized: ", err)
 	}
 
-	for {
-		address := <-checkBalanceChan
-		fmt.Println("the address is ", string(address[:]))
-
+	balance, err := c.BalanceAt(context.Background(), common.HexToAddress(string(address)), nil)
+	if err != nil {
+		fmt.Println("Balance at error ", err)
+	}
+	fmt.Println("The balance for address ", string(address), " is ", balance)
 
-		balance, error := c.BalanceAt(context.Background(), common.HexToAddress(string(address[:])),nil)
-		if error != nil {
-			fmt.Println("Balance at error ", error)
-		}
-		mutex.Lock()
-		fmt.Println("in broadcasting balance")
-		fmt.Println("the bal is ", balance)
-		fmt.Println("The balance for address ", string(address[:]), " is ", balance)
-		fmt.Println([]byte("Broadcasting Balance"))
-		fmt.Println([]byte("\n"))
-		fmt.Println([]byte(balance.String()))
-		fmt.Println([]byte("\n"))
-		conn.Write([]byte("Broadcasting Balance"))
-		conn.Write([]byte("\n"))
-		conn.Write([]byte(balance.String()))
-		conn.Write([]byte("\n"))
-		mutex.Unlock()
+	if err := wc.WriteFrame(MsgBroadcastBalance, []byte(balance.String())); err != nil {
+		fmt.Println("write balance frame error: ", err)
 	}
 }
 
-func sendRingSignedMsg(conn net.Conn){
+func sendRingSignedMsg(wc *walletConn) {
 	key, _ := crypto.HexToECDSA(testPrivHex)
 
 	f_msg := "Hello World"
 	first_message := []byte(f_msg)
-	new_msg2 := crypto.Keccak256(first_message)
+	msgHash := crypto.Keccak256(first_message)
+
+	members, signerIdx := loadRing(&key.PublicKey)
+	sig, err := ring.Sign(msgHash, members, signerIdx, key)
+	if err != nil {
+		fmt.Println("ring.Sign err is ", err)
+		return
+	}
 
-	//send_message := append(new_msg2, []byte{byte(10)}...)
-	new_sig, err := crypto.Sign(new_msg2, key)
+	payload, err := packRingMessage(first_message, members, sig)
 	if err != nil {
-		fmt.Println("The crypto.Sign err is ", err)
+		fmt.Println("pack ring message error: ", err)
+		return
 	}
 
-	mutex.Lock()
-	fmt.Println("in broadcasting message")
-	fmt.Println([]byte("Broadcasting Message"))
-	fmt.Println([]byte("\n"))
-	fmt.Println([]byte(f_msg))
-	fmt.Println([]byte("\n"))
-	fmt.Println(new_sig)
-	fmt.Println([]byte("\n"))
-	conn.Write([]byte("Broadcasting Message"))
-	time.Sleep(1000 * time.Millisecond)
-	conn.Write([]byte("\n"))
-	time.Sleep(3000 * time.Millisecond)
-	conn.Write([]byte(f_msg))
-	time.Sleep(1000 * time.Millisecond)
-	conn.Write([]byte("\n"))
-	conn.Write(new_sig)
-	time.Sleep(1000 * time.Millisecond)
-	conn.Write([]byte("\n"))
-	mutex.Unlock()
-}
\ No newline at end of file
+	fmt.Println("in broadcasting ring-signed message")
+	if err := wc.WriteFrame(MsgBroadcastMessage, payload); err != nil {
+		fmt.Println("write message frame error: ", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// frameMagic identifies the start of a walletConn frame. It guards against
+// reading garbage as a frame header if the stream ever desyncs.
+const frameMagic uint32 = 0x22400891
+
+// Frame message types.
+const (
+	MsgAddress = iota + 1
+	MsgGetBalance
+	MsgSignature
+	MsgMessage
+	MsgBroadcastBalance
+	MsgBroadcastMessage
+)
+
+// frameHeaderLen is magic(4) || type(1) || length(4).
+const frameHeaderLen = 4 + 1 + 4
+
+// maxFrameSize bounds the length field read by ReadFrame, so a single
+// forged header can't make us allocate gigabytes before the frame's
+// payload has even arrived.
+const maxFrameSize = 16 * 1024 * 1024
+
+// walletConn wraps a net.Conn with the wallet server's frame protocol:
+// magic(4) || type(1) || length(4, big-endian) || payload(length). It
+// replaces the old newline-delimited, string-header framing, which broke
+// whenever a signature or hash happened to contain a 0x0a byte.
+type walletConn struct {
+	conn net.Conn
+	wmu  sync.Mutex // guards writes, since frames may be written from multiple goroutines
+}
+
+func newWalletConn(conn net.Conn) *walletConn {
+	return &walletConn{conn: conn}
+}
+
+// ReadFrame blocks until a full frame has been read off the connection.
+func (w *walletConn) ReadFrame() (msgType byte, payload []byte, err error) {
+	var header [frameHeaderLen]byte
+	if _, err = io.ReadFull(w.conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if magic := binary.BigEndian.Uint32(header[:4]); magic != frameMagic {
+		return 0, nil, fmt.Errorf("bad frame magic %#x", magic)
+	}
+	msgType = header[4]
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > maxFrameSize {
+		return 0, nil, fmt.Errorf("frame size %d exceeds maximum of %d", length, maxFrameSize)
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(w.conn, payload); err != nil {
+		return 0, nil, err
+	}
+	return msgType, payload, nil
+}
+
+// WriteFrame writes a single frame. It is safe for concurrent use.
+func (w *walletConn) WriteFrame(msgType byte, payload []byte) error {
+	header := make([]byte, frameHeaderLen)
+	binary.BigEndian.PutUint32(header[:4], frameMagic)
+	header[4] = msgType
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	if _, err := w.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := w.conn.Write(payload)
+	return err
+}
+
+func (w *walletConn) Close() error {
+	return w.conn.Close()
+}